@@ -0,0 +1,354 @@
+// Copyright (C) 2023  mieru authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package protocolv2
+
+import (
+	"context"
+	"fmt"
+	"math/bits"
+	"time"
+)
+
+const (
+	// initialRTO is used before the first RTT sample is available.
+	initialRTO = 3 * time.Second
+
+	minRTO = 200 * time.Millisecond
+	maxRTO = 60 * time.Second
+
+	// fastRetransmitThreshold is the number of skip-ACKs (ACKs that cover a
+	// later segment while this one is still outstanding) that trigger an
+	// immediate retransmission, bypassing the RTO timer.
+	fastRetransmitThreshold = 3
+
+	// delayedAckInterval bounds how long the receiver waits, hoping to
+	// piggyback on more incoming data, before it must send a bare ACK.
+	delayedAckInterval = 20 * time.Millisecond
+
+	// sackWindowBits is the width of the SACK bitmap carried in an ACK
+	// payload. Bit i (0-indexed) reports whether unAckSeq+1+i was received.
+	sackWindowBits = 32
+
+	// initialCwnd and initialSsthresh follow the conservative end of
+	// RFC 5681 slow start, expressed in segments rather than bytes since
+	// mieru segments are close to a fixed MTU.
+	initialCwnd     = 4
+	initialSsthresh = 64
+
+	// retransmitPollInterval is how often runRetransmissionLoop scans
+	// inFlight for expired timers. It is intentionally finer than RTO
+	// clamping so backoff feels smooth rather than chunky.
+	retransmitPollInterval = 20 * time.Millisecond
+
+	// maxRetries caps exponential RTO backoff; beyond this the peer is
+	// considered unreachable and the segment is dropped with the session
+	// left to notice via other means (deadlines, Close).
+	maxRetries = 12
+)
+
+// inFlightSegment tracks a segment that has left sendBuf for the wire but
+// has not yet been cumulatively or selectively acknowledged.
+type inFlightSegment struct {
+	seg      *segment
+	sentAt   time.Time
+	retries  int
+	skipAcks int
+}
+
+// arqState holds the UDP reliability/congestion bookkeeping for a Session.
+// Every Session allocates one, but it is only used when the underlay
+// transport is UDP; TCP already provides ordering and retransmission, so
+// over TCP the fields keep their initial values and are never consulted.
+type arqState struct {
+	inFlight map[uint32]*inFlightSegment
+
+	nextRecvSeq uint32 // next seq the receiver expects, for recvBuf reassembly
+
+	// peerFinalSeq and peerFinalSeqKnown record the finalSeq carried by the
+	// peer's closeSessionRequest: the receive side is only complete once
+	// nextRecvSeq has caught up to it, not merely once the request itself
+	// has arrived (it may race ahead of data still in flight).
+	peerFinalSeq      uint32
+	peerFinalSeqKnown bool
+
+	srtt, rttvar, rto time.Duration
+
+	cwnd, ssthresh float64 // in segments
+	peerWindow     uint32  // last windowSize advertised by the peer
+
+	ackTimer   *time.Timer
+	ackPending bool
+}
+
+func newARQState() *arqState {
+	return &arqState{
+		inFlight:   make(map[uint32]*inFlightSegment),
+		rto:        initialRTO,
+		cwnd:       initialCwnd,
+		ssthresh:   initialSsthresh,
+		peerWindow: initialCwnd,
+	}
+}
+
+// rttSample folds a fresh RTT measurement into the smoothed estimators
+// using the RFC 6298 formulas and re-derives RTO from them.
+func (a *arqState) rttSample(r time.Duration) {
+	if a.srtt == 0 {
+		a.srtt = r
+		a.rttvar = r / 2
+	} else {
+		diff := a.srtt - r
+		if diff < 0 {
+			diff = -diff
+		}
+		a.srtt = a.srtt*7/8 + r/8
+		a.rttvar = a.rttvar*3/4 + diff/4
+	}
+	rto := a.srtt + 4*a.rttvar
+	if rto < minRTO {
+		rto = minRTO
+	} else if rto > maxRTO {
+		rto = maxRTO
+	}
+	a.rto = rto
+}
+
+// growCwnd grows the congestion window after a successful ACK,
+// the way TCP Reno does: +1 segment per ACK below ssthresh, +1/cwnd above it.
+func (a *arqState) growCwnd() {
+	if a.cwnd < a.ssthresh {
+		a.cwnd++
+	} else {
+		a.cwnd += 1 / a.cwnd
+	}
+}
+
+// onLoss halves the window and drops ssthresh, per standard AIMD backoff.
+func (a *arqState) onLoss() {
+	a.ssthresh = a.cwnd / 2
+	if a.ssthresh < initialCwnd {
+		a.ssthresh = initialCwnd
+	}
+	a.cwnd = a.ssthresh
+}
+
+// availableWindow is how many more unacknowledged segments may be in flight.
+func (a *arqState) availableWindow() int {
+	limit := a.cwnd
+	if float64(a.peerWindow) < limit {
+		limit = float64(a.peerWindow)
+	}
+	n := int(limit) - len(a.inFlight)
+	if n < 0 {
+		n = 0
+	}
+	return n
+}
+
+// encodeSACK builds a bitmap, relative to base, of which of the next
+// sackWindowBits sequence numbers are present in recvBuf.
+func (s *Session) encodeSACK(base uint32) uint32 {
+	var bitmap uint32
+	for i := 0; i < sackWindowBits; i++ {
+		if s.recvBuf.Contains(base + 1 + uint32(i)) {
+			bitmap |= 1 << uint(i)
+		}
+	}
+	return bitmap
+}
+
+// onSegmentSent records bookkeeping needed for retransmission once a data
+// segment has been handed to the UDP underlay.
+func (s *Session) onSegmentSent(seg *segment) {
+	s.arq.inFlight[seg.Seq()] = &inFlightSegment{
+		seg:    seg,
+		sentAt: time.Now(),
+	}
+}
+
+// onAckReceived applies a cumulative unAckSeq plus a SACK bitmap to the
+// in-flight table, retiring any newly acked/SACKed segment from sendBuf as
+// well so the bounded tree never fills up behind a session that keeps
+// getting acked, updates the RTT estimators from every newly acked or
+// SACKed segment that was never retransmitted, and adjusts the congestion
+// window.
+func (s *Session) onAckReceived(unAckSeq uint32, sack uint32, windowSize uint16) {
+	s.arqLock.Lock()
+	defer s.arqLock.Unlock()
+
+	s.arq.peerWindow = uint32(windowSize)
+	acked := false
+
+	// Only a SACK bit can cover a segment later than an outstanding one;
+	// highestSacked is the latest sequence number this ACK reports.
+	var highestSacked uint32
+	if sack != 0 {
+		highestSacked = unAckSeq + 1 + uint32(31-bits.LeadingZeros32(sack))
+	}
+
+	for seq, f := range s.arq.inFlight {
+		if seq < unAckSeq {
+			if f.retries == 0 {
+				s.arq.rttSample(time.Since(f.sentAt))
+				s.metrics.setRTT(s.arq.srtt.Microseconds())
+			}
+			delete(s.arq.inFlight, seq)
+			s.sendBuf.Delete(seq)
+			acked = true
+			continue
+		}
+		if seq-unAckSeq-1 < sackWindowBits && sack&(1<<uint(seq-unAckSeq-1)) != 0 {
+			if f.retries == 0 {
+				s.arq.rttSample(time.Since(f.sentAt))
+				s.metrics.setRTT(s.arq.srtt.Microseconds())
+			}
+			delete(s.arq.inFlight, seq)
+			s.sendBuf.Delete(seq)
+			acked = true
+			continue
+		}
+		// Segment is still outstanding but a later one was just acked.
+		if sack != 0 && seq < highestSacked {
+			f.skipAcks++
+		}
+	}
+
+	if acked {
+		s.arq.growCwnd()
+	}
+}
+
+// runRetransmissionLoop periodically scans inFlight for segments that have
+// either exceeded their RTO or collected fastRetransmitThreshold skip-ACKs,
+// and retransmits them with exponential backoff.
+func (s *Session) runRetransmissionLoop(ctx context.Context) error {
+	ticker := time.NewTicker(retransmitPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-s.done:
+			return nil
+		case <-ticker.C:
+			s.retransmitExpired()
+		}
+	}
+}
+
+func (s *Session) retransmitExpired() {
+	s.arqLock.Lock()
+	now := time.Now()
+	var toSend []*segment
+	backedOff := false
+	for seq, f := range s.arq.inFlight {
+		due := f.skipAcks >= fastRetransmitThreshold || now.Sub(f.sentAt) >= s.arq.rto
+		if !due {
+			continue
+		}
+		if f.retries >= maxRetries {
+			delete(s.arq.inFlight, seq)
+			s.metrics.addDropped(dropReasonWriteTimeout)
+			continue
+		}
+		f.retries++
+		f.skipAcks = 0
+		f.sentAt = now
+		if !backedOff {
+			// Back off once per scan, not once per due segment: a single
+			// burst loss can leave many segments due in the same tick, and
+			// that is one loss event, not N of them.
+			s.arq.rto *= 2
+			if s.arq.rto > maxRTO {
+				s.arq.rto = maxRTO
+			}
+			backedOff = true
+		}
+		toSend = append(toSend, f.seg)
+	}
+	if len(toSend) > 0 {
+		s.arq.onLoss()
+	}
+	s.arqLock.Unlock()
+
+	for _, seg := range toSend {
+		if err := s.output(seg); err == nil {
+			s.metrics.addRetransmit()
+		}
+	}
+}
+
+// scheduleDelayedAck arms (or leaves armed) the timer that flushes a bare
+// ACK for data that arrived without a piggyback opportunity. If the peer
+// never negotiated featureDelayedACK it has no reason to expect the delay,
+// so the ACK goes out immediately instead.
+func (s *Session) scheduleDelayedAck() {
+	if s.features&featureDelayedACK == 0 {
+		s.flushDelayedAck()
+		return
+	}
+
+	s.arqLock.Lock()
+	defer s.arqLock.Unlock()
+	if s.arq.ackPending {
+		return
+	}
+	s.arq.ackPending = true
+	if s.arq.ackTimer == nil {
+		s.arq.ackTimer = time.AfterFunc(delayedAckInterval, s.flushDelayedAck)
+	} else {
+		s.arq.ackTimer.Reset(delayedAckInterval)
+	}
+}
+
+func (s *Session) flushDelayedAck() {
+	s.arqLock.Lock()
+	s.arq.ackPending = false
+	unAckSeq := s.arq.nextRecvSeq
+	var sack uint32
+	if s.features&featureSACK != 0 {
+		sack = s.encodeSACK(unAckSeq)
+	}
+	s.arqLock.Unlock()
+
+	seg := &segment{
+		metadata: &dataAckStruct{
+			sessionID:  s.id,
+			unAckSeq:   unAckSeq,
+			windowSize: uint16(s.recvBuf.Remaining()),
+		},
+		payload: encodeSACKPayload(sack),
+	}
+	_ = s.output(seg)
+}
+
+// encodeSACKPayload / decodeSACKPayload give the ack segment's payload a
+// stable wire shape: a single big-endian uint32 bitmap.
+func encodeSACKPayload(bitmap uint32) []byte {
+	return []byte{
+		byte(bitmap >> 24),
+		byte(bitmap >> 16),
+		byte(bitmap >> 8),
+		byte(bitmap),
+	}
+}
+
+func decodeSACKPayload(b []byte) (uint32, error) {
+	if len(b) < 4 {
+		return 0, fmt.Errorf("SACK payload too short: %d bytes", len(b))
+	}
+	return uint32(b[0])<<24 | uint32(b[1])<<16 | uint32(b[2])<<8 | uint32(b[3]), nil
+}
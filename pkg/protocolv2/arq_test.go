@@ -0,0 +1,131 @@
+// Copyright (C) 2023  mieru authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package protocolv2
+
+import (
+	"testing"
+	"time"
+)
+
+func TestArqStateRTTSample(t *testing.T) {
+	a := newARQState()
+
+	a.rttSample(100 * time.Millisecond)
+	if a.srtt != 100*time.Millisecond {
+		t.Fatalf("first sample should seed srtt directly, got %v", a.srtt)
+	}
+	if a.rttvar != 50*time.Millisecond {
+		t.Fatalf("first sample should seed rttvar to half the sample, got %v", a.rttvar)
+	}
+
+	a.rttSample(300 * time.Millisecond)
+	wantSrtt := 100*time.Millisecond*7/8 + 300*time.Millisecond/8
+	if a.srtt != wantSrtt {
+		t.Fatalf("srtt = %v, want %v", a.srtt, wantSrtt)
+	}
+
+	if a.rto < minRTO || a.rto > maxRTO {
+		t.Fatalf("rto %v out of [minRTO, maxRTO] bounds", a.rto)
+	}
+}
+
+func TestArqStateRTOClamping(t *testing.T) {
+	a := newARQState()
+
+	a.rttSample(1 * time.Millisecond)
+	if a.rto != minRTO {
+		t.Fatalf("rto = %v, want clamped to minRTO %v", a.rto, minRTO)
+	}
+
+	a = newARQState()
+	a.rttSample(time.Hour)
+	if a.rto != maxRTO {
+		t.Fatalf("rto = %v, want clamped to maxRTO %v", a.rto, maxRTO)
+	}
+}
+
+func TestArqStateGrowCwnd(t *testing.T) {
+	a := newARQState()
+	a.cwnd = 2
+	a.ssthresh = 10
+
+	a.growCwnd()
+	if a.cwnd != 3 {
+		t.Fatalf("below ssthresh: cwnd = %v, want 3", a.cwnd)
+	}
+
+	a.cwnd = 10
+	before := a.cwnd
+	a.growCwnd()
+	if a.cwnd <= before || a.cwnd >= before+1 {
+		t.Fatalf("at/above ssthresh: cwnd should grow by ~1/cwnd, got %v from %v", a.cwnd, before)
+	}
+}
+
+func TestArqStateOnLoss(t *testing.T) {
+	a := newARQState()
+	a.cwnd = 20
+	a.ssthresh = 40
+
+	a.onLoss()
+	if a.ssthresh != 10 {
+		t.Fatalf("ssthresh = %v, want half of cwnd (10)", a.ssthresh)
+	}
+	if a.cwnd != a.ssthresh {
+		t.Fatalf("cwnd = %v, want to match new ssthresh %v", a.cwnd, a.ssthresh)
+	}
+
+	a.cwnd = 1
+	a.onLoss()
+	if a.ssthresh != initialCwnd {
+		t.Fatalf("ssthresh should not drop below initialCwnd, got %v", a.ssthresh)
+	}
+}
+
+func TestArqStateAvailableWindow(t *testing.T) {
+	a := newARQState()
+	a.cwnd = 4
+	a.peerWindow = 2
+
+	if got := a.availableWindow(); got != 2 {
+		t.Fatalf("availableWindow() = %d, want 2 (bounded by peerWindow)", got)
+	}
+
+	a.inFlight[0] = &inFlightSegment{}
+	a.inFlight[1] = &inFlightSegment{}
+	if got := a.availableWindow(); got != 0 {
+		t.Fatalf("availableWindow() = %d, want 0 once inFlight reaches the window", got)
+	}
+}
+
+func TestEncodeDecodeSACKPayload(t *testing.T) {
+	for _, bitmap := range []uint32{0, 1, 0xDEADBEEF, 0xFFFFFFFF} {
+		b := encodeSACKPayload(bitmap)
+		got, err := decodeSACKPayload(b)
+		if err != nil {
+			t.Fatalf("decodeSACKPayload(%x) failed: %v", bitmap, err)
+		}
+		if got != bitmap {
+			t.Fatalf("round trip = %x, want %x", got, bitmap)
+		}
+	}
+}
+
+func TestDecodeSACKPayloadTooShort(t *testing.T) {
+	if _, err := decodeSACKPayload([]byte{1, 2, 3}); err == nil {
+		t.Fatal("decodeSACKPayload() with 3 bytes should fail, got nil error")
+	}
+}
@@ -0,0 +1,242 @@
+// Copyright (C) 2023  mieru authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package protocolv2
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/enfein/mieru/pkg/netutil"
+)
+
+const (
+	// closeFlushTimeout bounds how long Close/CloseWrite wait for
+	// previously queued data to actually leave sendQueue/sendBuf before
+	// the FIN-like closeSessionRequest is sent.
+	closeFlushTimeout = 2 * time.Second
+
+	// closeResponseTimeout bounds how long Close/CloseWrite wait for the
+	// peer's closeSessionResponse before giving up and releasing
+	// resources anyway.
+	closeResponseTimeout = 3 * time.Second
+)
+
+// closeStruct is the metadata of a closeSessionRequest/closeSessionResponse
+// segment: a minimal FIN/FIN-ACK pair that carries the sender's final
+// sequence number so the peer can tell whether it has seen everything.
+type closeStruct struct {
+	sessionID  uint32
+	finalSeq   uint32
+	isResponse bool
+}
+
+func (c *closeStruct) Protocol() segmentType {
+	if c.isResponse {
+		return closeSessionResponse
+	}
+	return closeSessionRequest
+}
+
+func newCloseSegment(sessionID, finalSeq uint32, isResponse bool) *segment {
+	return &segment{metadata: &closeStruct{sessionID: sessionID, finalSeq: finalSeq, isResponse: isResponse}}
+}
+
+// CloseWrite shuts down the write half of the session: it flushes whatever
+// is still queued to send, tells the peer no more data is coming via
+// closeSessionRequest, and waits (bounded by closeResponseTimeout) for
+// closeSessionResponse. After it returns, Write always fails, but Read
+// keeps working until the peer closes its own write side or Close/CloseRead
+// is called locally.
+func (s *Session) CloseWrite() error {
+	if !s.writeClosed.CompareAndSwap(false, true) {
+		return nil
+	}
+
+	s.setClosing()
+	s.flushSendSide(closeFlushTimeout)
+
+	if s.features&featureCloseSession == 0 {
+		// The peer never negotiated featureCloseSession, so it has no
+		// handler for closeSessionRequest/closeSessionResponse; sending one
+		// would just sit there unacknowledged until closeResponseTimeout.
+		// Stop after flushing instead of running a handshake the peer can't
+		// speak.
+		return nil
+	}
+
+	s.wLock.Lock()
+	finalSeq := s.nextSeq
+	s.wLock.Unlock()
+	if err := s.output(newCloseSegment(s.id, finalSeq, false)); err != nil {
+		return fmt.Errorf("output() failed to send closeSessionRequest: %w", err)
+	}
+
+	select {
+	case <-s.closeRespChan:
+	case <-time.After(closeResponseTimeout):
+	}
+	return nil
+}
+
+// CloseRead shuts down the read half of the session: a pending Read that is
+// waiting for data returns io.EOF immediately, and later Read calls still
+// return data already in recvQueue, then io.EOF once it is empty. The wire protocol has no separate
+// "stop sending to me" message, so this only affects what this side
+// delivers to the application; it does not notify the peer.
+func (s *Session) CloseRead() error {
+	if s.readClosed.CompareAndSwap(false, true) {
+		close(s.localReadClosedChan)
+	}
+	return nil
+}
+
+// Close terminates the session in both directions: CloseWrite's FIN/wait
+// sequence, followed by a local CloseRead, before releasing resources.
+func (s *Session) Close() error {
+	s.closeOnce.Do(func() {
+		s.CloseWrite()
+		s.CloseRead()
+		s.setState(sessionClosed)
+		close(s.done)
+		s.metrics.close(s.id)
+	})
+	return nil
+}
+
+func (s *Session) setClosing() {
+	s.stateLock.Lock()
+	if s.state < sessionClosing {
+		s.state = sessionClosing
+	}
+	s.stateLock.Unlock()
+}
+
+func (s *Session) setState(state sessionState) {
+	s.stateLock.Lock()
+	s.state = state
+	s.stateLock.Unlock()
+}
+
+// flushSendSide waits up to timeout for sendQueue and sendBuf to drain, so
+// data already accepted by Write has a chance to actually reach the wire
+// (and, over UDP, be acknowledged) before the session announces its final
+// sequence number. Anything still queued once timeout elapses is abandoned
+// and counted as dropped, since it will never be sent or retransmitted
+// after the session moves on to closing.
+func (s *Session) flushSendSide(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if s.sendQueue.Len() == 0 && s.sendBuf.Len() == 0 {
+			return
+		}
+		time.Sleep(segmentPollInterval)
+	}
+
+	for {
+		if _, err := s.sendQueue.DeleteMin(); err != nil {
+			break
+		}
+		s.metrics.addDropped(dropReasonSessionClosing)
+	}
+	for {
+		seg, err := s.sendBuf.DeleteMin()
+		if err != nil {
+			break
+		}
+		s.arqLock.Lock()
+		delete(s.arq.inFlight, seg.Seq())
+		s.arqLock.Unlock()
+		s.metrics.addDropped(dropReasonSessionClosing)
+	}
+}
+
+// inputCloseSessionRequest handles the peer announcing it has no more data
+// to send. Over TCP, delivery is already in order, so the stream is
+// complete the moment the request arrives. Over UDP, the request carries
+// the sender's finalSeq, which may race ahead of data segments still in
+// flight (or being retransmitted): promoteContiguousRecv only declares the
+// stream complete, and closes peerFinChan to unblock a waiting Read, once
+// reassembly actually reaches finalSeq. Either way, closeSessionResponse
+// acknowledges the request immediately.
+func (s *Session) inputCloseSessionRequest(seg *segment) error {
+	cs, ok := seg.metadata.(*closeStruct)
+	if !ok {
+		return fmt.Errorf("closeSessionRequest segment has unexpected metadata type %T", seg.metadata)
+	}
+
+	switch s.conn.TransportProtocol() {
+	case netutil.TCPTransport:
+		s.peerFinOnce.Do(func() { close(s.peerFinChan) })
+	case netutil.UDPTransport:
+		s.arqLock.Lock()
+		s.arq.peerFinalSeq = cs.finalSeq
+		s.arq.peerFinalSeqKnown = true
+		s.arqLock.Unlock()
+		s.promoteContiguousRecv()
+	default:
+		return fmt.Errorf("unsupported transport protocol %v", s.conn.TransportProtocol())
+	}
+
+	s.wLock.Lock()
+	finalSeq := s.nextSeq
+	s.wLock.Unlock()
+	resp := newCloseSegment(s.id, finalSeq, true)
+	if err := s.output(resp); err != nil {
+		return fmt.Errorf("output() failed to send closeSessionResponse: %w", err)
+	}
+	return nil
+}
+
+func (s *Session) inputCloseSessionResponse(seg *segment) error {
+	s.closeRespOnce.Do(func() { close(s.closeRespChan) })
+	return nil
+}
+
+func (s *Session) isReadClosed() bool {
+	return s.readClosed.Load()
+}
+
+// readContext extends withDeadline with the two additional ways a blocked
+// Read must unblock: CloseRead/Close locally, or the peer's
+// closeSessionRequest. Both report io.EOF, matching the read-half-closed
+// convention the rest of the standard library uses.
+func (s *Session) readContext() (context.Context, func() error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	deadlineCh := s.readDeadline.wait()
+	result := make(chan error, 1)
+	go func() {
+		select {
+		case <-deadlineCh:
+			result <- os.ErrDeadlineExceeded
+		case <-s.done:
+			result <- io.ErrClosedPipe
+		case <-s.localReadClosedChan:
+			result <- io.EOF
+		case <-s.peerFinChan:
+			result <- io.EOF
+		case <-ctx.Done():
+			result <- nil
+		}
+		cancel()
+	}()
+	return ctx, func() error {
+		cancel()
+		return <-result
+	}
+}
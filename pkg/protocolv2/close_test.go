@@ -0,0 +1,91 @@
+// Copyright (C) 2023  mieru authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package protocolv2
+
+import (
+	"io"
+	"testing"
+)
+
+func TestCloseReadIsIdempotentAndUnblocksLocalReadClosedChan(t *testing.T) {
+	s := NewSession(1, true, 1400)
+	defer s.metrics.close(s.id)
+
+	if s.isReadClosed() {
+		t.Fatal("new session should not start read-closed")
+	}
+
+	if err := s.CloseRead(); err != nil {
+		t.Fatalf("CloseRead() failed: %v", err)
+	}
+	if !s.isReadClosed() {
+		t.Fatal("isReadClosed() should be true after CloseRead()")
+	}
+	select {
+	case <-s.localReadClosedChan:
+	default:
+		t.Fatal("localReadClosedChan should be closed after CloseRead()")
+	}
+
+	// A second call must not panic (close of a closed channel) or otherwise
+	// misbehave.
+	if err := s.CloseRead(); err != nil {
+		t.Fatalf("second CloseRead() failed: %v", err)
+	}
+}
+
+func TestSetClosingAndSetState(t *testing.T) {
+	s := NewSession(1, true, 1400)
+	defer s.metrics.close(s.id)
+
+	s.setClosing()
+	if s.state != sessionClosing {
+		t.Fatalf("state = %v, want sessionClosing", s.state)
+	}
+
+	// setClosing must not downgrade a state that is already further along.
+	s.setState(sessionClosed)
+	s.setClosing()
+	if s.state != sessionClosed {
+		t.Fatalf("setClosing() downgraded state from sessionClosed to %v", s.state)
+	}
+}
+
+func TestReadContextReportsEOFOnLocalReadClosed(t *testing.T) {
+	s := NewSession(1, true, 1400)
+	defer s.metrics.close(s.id)
+
+	ctx, cause := s.readContext()
+	if err := s.CloseRead(); err != nil {
+		t.Fatalf("CloseRead() failed: %v", err)
+	}
+	<-ctx.Done()
+	if err := cause(); err != io.EOF {
+		t.Fatalf("cause() = %v, want io.EOF", err)
+	}
+}
+
+func TestReadContextReportsEOFOnPeerFin(t *testing.T) {
+	s := NewSession(1, true, 1400)
+	defer s.metrics.close(s.id)
+
+	ctx, cause := s.readContext()
+	s.peerFinOnce.Do(func() { close(s.peerFinChan) })
+	<-ctx.Done()
+	if err := cause(); err != io.EOF {
+		t.Fatalf("cause() = %v, want io.EOF", err)
+	}
+}
@@ -0,0 +1,116 @@
+// Copyright (C) 2023  mieru authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package protocolv2
+
+import (
+	"context"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// deadlineTimer is a mutable net.Conn style deadline, modeled on the one
+// net.Pipe uses internally: `cancel` is closed the instant the deadline is
+// reached, and a blocked goroutine that grabbed the channel via wait()
+// before the deadline was (re)armed still observes the close, so resetting
+// the deadline while a call is in flight applies the new deadline to that
+// call: it unblocks as soon as the new deadline is reached.
+type deadlineTimer struct {
+	mu     sync.Mutex
+	timer  *time.Timer
+	cancel chan struct{}
+}
+
+func makeDeadlineTimer() deadlineTimer {
+	return deadlineTimer{cancel: make(chan struct{})}
+}
+
+// set arms, disarms or clears the deadline.
+func (d *deadlineTimer) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.timer != nil && !d.timer.Stop() {
+		<-d.cancel
+	}
+	d.timer = nil
+
+	closed := isClosedChan(d.cancel)
+	if t.IsZero() {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		return
+	}
+
+	dur := time.Until(t)
+	if dur <= 0 {
+		if !closed {
+			close(d.cancel)
+		}
+		return
+	}
+
+	if closed {
+		d.cancel = make(chan struct{})
+	}
+	cancel := d.cancel
+	d.timer = time.AfterFunc(dur, func() {
+		close(cancel)
+	})
+}
+
+// wait returns the channel that closes once the current deadline is reached.
+func (d *deadlineTimer) wait() chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.cancel
+}
+
+func isClosedChan(c chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
+
+// withDeadline returns a context that is canceled when d's deadline fires or
+// s is closed, plus a function that must be called exactly once to learn
+// whether cancellation was caused by the deadline, the session closing, or
+// neither (the normal, uncancelled-completion case).
+func (s *Session) withDeadline(d *deadlineTimer) (context.Context, func() error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	deadlineCh := d.wait()
+	result := make(chan error, 1)
+	go func() {
+		select {
+		case <-deadlineCh:
+			result <- os.ErrDeadlineExceeded
+		case <-s.done:
+			result <- io.ErrClosedPipe
+		case <-ctx.Done():
+			result <- nil
+		}
+		cancel()
+	}()
+	return ctx, func() error {
+		cancel()
+		return <-result
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright (C) 2023  mieru authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package protocolv2
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDeadlineTimerZeroNeverFires(t *testing.T) {
+	d := makeDeadlineTimer()
+	select {
+	case <-d.wait():
+		t.Fatal("zero-value deadline should never fire")
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func TestDeadlineTimerPastFiresImmediately(t *testing.T) {
+	d := makeDeadlineTimer()
+	d.set(time.Now().Add(-time.Second))
+	select {
+	case <-d.wait():
+	case <-time.After(100 * time.Millisecond):
+		t.Fatal("deadline in the past should have already fired")
+	}
+}
+
+func TestDeadlineTimerFuture(t *testing.T) {
+	d := makeDeadlineTimer()
+	d.set(time.Now().Add(20 * time.Millisecond))
+
+	ch := d.wait()
+	select {
+	case <-ch:
+		t.Fatal("deadline fired before it was due")
+	default:
+	}
+
+	select {
+	case <-ch:
+	case <-time.After(200 * time.Millisecond):
+		t.Fatal("deadline did not fire after its duration elapsed")
+	}
+}
+
+func TestDeadlineTimerClearAfterFiring(t *testing.T) {
+	d := makeDeadlineTimer()
+	d.set(time.Now().Add(-time.Second))
+	<-d.wait()
+
+	// Clearing the deadline after it already fired must hand out a fresh,
+	// unfired channel, not the closed one.
+	d.set(time.Time{})
+	select {
+	case <-d.wait():
+		t.Fatal("cleared deadline should not be fired")
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func TestDeadlineTimerResetUnblocksInFlightWaiter(t *testing.T) {
+	d := makeDeadlineTimer()
+	d.set(time.Now().Add(time.Hour))
+	ch := d.wait()
+
+	done := make(chan struct{})
+	go func() {
+		<-ch
+		close(done)
+	}()
+
+	// Rearming to a near-immediate deadline must close the channel the
+	// waiter already grabbed, rather than leaving it blocked forever.
+	d.set(time.Now().Add(10 * time.Millisecond))
+
+	select {
+	case <-done:
+	case <-time.After(200 * time.Millisecond):
+		t.Fatal("resetting the deadline did not unblock the in-flight waiter")
+	}
+}
+
+func TestIsClosedChan(t *testing.T) {
+	c := make(chan struct{})
+	if isClosedChan(c) {
+		t.Fatal("open channel reported as closed")
+	}
+	close(c)
+	if !isClosedChan(c) {
+		t.Fatal("closed channel reported as open")
+	}
+}
@@ -0,0 +1,153 @@
+// Copyright (C) 2023  mieru authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package protocolv2
+
+import (
+	"expvar"
+	"strconv"
+)
+
+// Reasons a packet can be dropped, used as the label on packetsDropped.
+// Modeled on DERP's packetsDroppedReason.
+const (
+	dropReasonQueueFull      = "queue_full"
+	dropReasonSessionClosing = "session_closing"
+	dropReasonUnknownPeer    = "unknown_peer"
+	dropReasonWriteTimeout   = "write_timeout"
+)
+
+// DropPolicy controls what Session.Write does when the send queue has
+// reached its configured depth.
+type DropPolicy int
+
+const (
+	// DropPolicyBlockWriter makes Write wait for room, same as the
+	// original unbounded InsertBlocking behavior.
+	DropPolicyBlockWriter DropPolicy = iota
+	// DropPolicyDropOldest evicts the oldest unsent segment to make room
+	// for the new one, trading data loss for a writer that never stalls.
+	DropPolicyDropOldest
+)
+
+// defaultSendQueueDepth matches the segmentTree's own capacity, so a
+// Session that never calls SetSendQueueDepth behaves exactly as before.
+const defaultSendQueueDepth = segmentTreeCapacity
+
+// Server-level aggregates across every Session in this process, modeled on
+// DERP's perClientSendQueueDepth + packetsDropped expvars: an operator can
+// watch queue saturation and loss fleet-wide without attaching a debugger.
+var (
+	serverBytesSent      expvar.Int
+	serverBytesRecv      expvar.Int
+	serverPacketsSent    expvar.Int
+	serverPacketsRecv    expvar.Int
+	serverPacketsDropped expvar.Map
+	serverRetransmits    expvar.Int
+	serverSessions       expvar.Int
+)
+
+// allSessionsExpvar publishes one sub-map per live session, keyed by
+// session ID, so per-session pressure is visible alongside the aggregate.
+var allSessionsExpvar expvar.Map
+
+func init() {
+	serverPacketsDropped.Init()
+	allSessionsExpvar.Init()
+
+	root := expvar.NewMap("mieru_protocolv2")
+	root.Set("bytesSent", &serverBytesSent)
+	root.Set("bytesRecv", &serverBytesRecv)
+	root.Set("packetsSent", &serverPacketsSent)
+	root.Set("packetsRecv", &serverPacketsRecv)
+	root.Set("packetsDropped", &serverPacketsDropped)
+	root.Set("retransmits", &serverRetransmits)
+	root.Set("sessions", &serverSessions)
+	root.Set("bySession", &allSessionsExpvar)
+}
+
+// RecordUnknownPeerDrop counts a packet that arrived for a session ID this
+// process has no record of, e.g. after a restart or a spoofed datagram.
+// Session has no notion of "unknown peer" about itself, so this is called
+// by whatever demultiplexes incoming packets to a Session.
+func RecordUnknownPeerDrop() {
+	serverPacketsDropped.Add(dropReasonUnknownPeer, 1)
+}
+
+// sessionMetrics is the per-Session counterpart of the expvars above.
+// It is always allocated, even for sessions that never hit a drop path,
+// so a dashboard can graph a session's RTT and queue pressure from zero.
+type sessionMetrics struct {
+	expMap expvar.Map
+
+	bytesSent      expvar.Int
+	bytesRecv      expvar.Int
+	packetsSent    expvar.Int
+	packetsRecv    expvar.Int
+	packetsDropped expvar.Map
+	retransmits    expvar.Int
+	rttMicros      expvar.Int
+}
+
+func newSessionMetrics(id uint32) *sessionMetrics {
+	m := &sessionMetrics{}
+	m.packetsDropped.Init()
+	m.expMap.Set("bytesSent", &m.bytesSent)
+	m.expMap.Set("bytesRecv", &m.bytesRecv)
+	m.expMap.Set("packetsSent", &m.packetsSent)
+	m.expMap.Set("packetsRecv", &m.packetsRecv)
+	m.expMap.Set("packetsDropped", &m.packetsDropped)
+	m.expMap.Set("retransmits", &m.retransmits)
+	m.expMap.Set("rttMicros", &m.rttMicros)
+
+	allSessionsExpvar.Set(strconv.FormatUint(uint64(id), 10), &m.expMap)
+	serverSessions.Add(1)
+	return m
+}
+
+// close unpublishes the session's expvar so the process doesn't accumulate
+// one entry per session ID ever created over its lifetime.
+func (m *sessionMetrics) close(id uint32) {
+	allSessionsExpvar.Delete(strconv.FormatUint(uint64(id), 10))
+	serverSessions.Add(-1)
+}
+
+func (m *sessionMetrics) addSent(n int) {
+	m.bytesSent.Add(int64(n))
+	m.packetsSent.Add(1)
+	serverBytesSent.Add(int64(n))
+	serverPacketsSent.Add(1)
+}
+
+func (m *sessionMetrics) addRecv(n int) {
+	m.bytesRecv.Add(int64(n))
+	m.packetsRecv.Add(1)
+	serverBytesRecv.Add(int64(n))
+	serverPacketsRecv.Add(1)
+}
+
+func (m *sessionMetrics) addDropped(reason string) {
+	m.packetsDropped.Add(reason, 1)
+	serverPacketsDropped.Add(reason, 1)
+}
+
+func (m *sessionMetrics) addRetransmit() {
+	m.retransmits.Add(1)
+	serverRetransmits.Add(1)
+}
+
+func (m *sessionMetrics) setRTT(micros int64) {
+	m.rttMicros.Set(micros)
+}
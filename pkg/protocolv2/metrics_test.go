@@ -0,0 +1,76 @@
+// Copyright (C) 2023  mieru authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package protocolv2
+
+import "testing"
+
+func TestSessionMetricsCounters(t *testing.T) {
+	// A unique ID avoids colliding with the expvar entry any other test
+	// (or a parallel run) may have already published under allSessionsExpvar.
+	m := newSessionMetrics(987654321)
+	defer m.close(987654321)
+
+	m.addSent(10)
+	m.addSent(5)
+	if got := m.bytesSent.Value(); got != 15 {
+		t.Fatalf("bytesSent = %d, want 15", got)
+	}
+	if got := m.packetsSent.Value(); got != 2 {
+		t.Fatalf("packetsSent = %d, want 2", got)
+	}
+
+	m.addRecv(7)
+	if got := m.bytesRecv.Value(); got != 7 {
+		t.Fatalf("bytesRecv = %d, want 7", got)
+	}
+	if got := m.packetsRecv.Value(); got != 1 {
+		t.Fatalf("packetsRecv = %d, want 1", got)
+	}
+
+	m.addDropped(dropReasonQueueFull)
+	m.addDropped(dropReasonQueueFull)
+	m.addDropped(dropReasonWriteTimeout)
+	if got := m.packetsDropped.Get(dropReasonQueueFull); got == nil || got.String() != "2" {
+		t.Fatalf("packetsDropped[%s] = %v, want 2", dropReasonQueueFull, got)
+	}
+	if got := m.packetsDropped.Get(dropReasonWriteTimeout); got == nil || got.String() != "1" {
+		t.Fatalf("packetsDropped[%s] = %v, want 1", dropReasonWriteTimeout, got)
+	}
+
+	m.addRetransmit()
+	if got := m.retransmits.Value(); got != 1 {
+		t.Fatalf("retransmits = %d, want 1", got)
+	}
+
+	m.setRTT(12345)
+	if got := m.rttMicros.Value(); got != 12345 {
+		t.Fatalf("rttMicros = %d, want 12345", got)
+	}
+}
+
+func TestSessionMetricsPublishAndClose(t *testing.T) {
+	const id = 987654322
+	m := newSessionMetrics(id)
+
+	if allSessionsExpvar.Get("987654322") == nil {
+		t.Fatal("newSessionMetrics() did not publish the session under allSessionsExpvar")
+	}
+
+	m.close(id)
+	if allSessionsExpvar.Get("987654322") != nil {
+		t.Fatal("close() did not unpublish the session from allSessionsExpvar")
+	}
+}
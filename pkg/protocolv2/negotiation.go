@@ -0,0 +1,240 @@
+// Copyright (C) 2023  mieru authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package protocolv2
+
+import (
+	"fmt"
+)
+
+// Protocol version 1. Bumping this lets a future version add new segment
+// metadata or transports while still being able to talk to old peers, who
+// will negotiate back down to the highest version they both understand.
+const negotiationVersion1 uint8 = 1
+
+const currentNegotiationVersion = negotiationVersion1
+
+// negotiationWireSize is the fixed size, in bytes, of a marshaled
+// negotiationParams: 1 (version) + 2 (mtu) + 2 (maxFragmentSize) + 4 (features).
+const negotiationWireSize = 9
+
+// featureBit is a single capability that may or may not be shared by both
+// peers. The server ANDs the client's proposed bitmap with what it supports,
+// so unknown future bits are silently dropped rather than rejected.
+type featureBit uint32
+
+const (
+	featureUDPARQ featureBit = 1 << iota
+	featureSACK
+	featureDelayedACK
+	featureCloseSession
+)
+
+// supportedFeatures is every feature this build of mieru understands.
+const supportedFeatures = featureUDPARQ | featureSACK | featureDelayedACK | featureCloseSession
+
+// negotiationRequest and negotiationResponse extend the segmentType enum
+// (alongside dataClientToServer, ackClientToServer, closeSessionRequest,
+// etc.) so the pre-session handshake travels inside a regular segment: it
+// gets the same length framing and per-segment obfuscation as every other
+// byte on the wire, instead of a fixed-size plaintext struct written
+// straight to the connection.
+const (
+	negotiationRequest  segmentType = 0xF0
+	negotiationResponse segmentType = 0xF1
+)
+
+// negotiationStruct is the metadata of a negotiationRequest/negotiationResponse
+// segment. negotiationParams itself travels in the segment payload, marshaled
+// by marshalNegotiationParams.
+type negotiationStruct struct {
+	isResponse bool
+}
+
+func (n *negotiationStruct) Protocol() segmentType {
+	if n.isResponse {
+		return negotiationResponse
+	}
+	return negotiationRequest
+}
+
+// negotiationParams is exchanged, once, before a Session is usable. The
+// client proposes; the server accepts or downgrades; both sides then build
+// their Session from the result rather than from locally hardcoded values.
+type negotiationParams struct {
+	version         uint8
+	mtu             uint16
+	maxFragmentSize uint16
+	features        featureBit
+}
+
+func marshalNegotiationParams(p negotiationParams) []byte {
+	b := make([]byte, negotiationWireSize)
+	b[0] = p.version
+	b[1] = byte(p.mtu >> 8)
+	b[2] = byte(p.mtu)
+	b[3] = byte(p.maxFragmentSize >> 8)
+	b[4] = byte(p.maxFragmentSize)
+	b[5] = byte(p.features >> 24)
+	b[6] = byte(p.features >> 16)
+	b[7] = byte(p.features >> 8)
+	b[8] = byte(p.features)
+	return b
+}
+
+func unmarshalNegotiationParams(b []byte) (negotiationParams, error) {
+	if len(b) < negotiationWireSize {
+		return negotiationParams{}, fmt.Errorf("negotiation message too short: got %d bytes, want %d", len(b), negotiationWireSize)
+	}
+	return negotiationParams{
+		version:         b[0],
+		mtu:             uint16(b[1])<<8 | uint16(b[2]),
+		maxFragmentSize: uint16(b[3])<<8 | uint16(b[4]),
+		features:        featureBit(b[5])<<24 | featureBit(b[6])<<16 | featureBit(b[7])<<8 | featureBit(b[8]),
+	}, nil
+}
+
+// writeNegotiationSegment hands seg to whichever underlay-specific framing
+// data and ack segments already use, the same type switch output() uses in
+// session.go.
+func writeNegotiationSegment(conn Underlay, seg *segment) error {
+	switch u := conn.(type) {
+	case *TCPUnderlay:
+		return u.writeOneSegment(seg)
+	case *UDPUnderlay:
+		return u.writeOneSegment(seg)
+	default:
+		return fmt.Errorf("underlay %T does not support pre-session negotiation", conn)
+	}
+}
+
+// readNegotiationSegment is the read-side counterpart of
+// writeNegotiationSegment: it blocks for exactly one negotiation segment
+// off conn, relying on the underlay's own framing to know where it ends.
+func readNegotiationSegment(conn Underlay) (*segment, error) {
+	switch u := conn.(type) {
+	case *TCPUnderlay:
+		return u.readOneSegment()
+	case *UDPUnderlay:
+		buf := make([]byte, MaxPDU)
+		return u.readOneSegment(buf)
+	default:
+		return nil, fmt.Errorf("underlay %T does not support pre-session negotiation", conn)
+	}
+}
+
+// negotiateClient sends the client's proposed parameters and returns
+// whatever the server accepted, which may be a downgraded version, MTU,
+// fragment size or feature set.
+func negotiateClient(conn Underlay, proposedMTU, proposedMaxFragmentSize int) (negotiationParams, error) {
+	req := negotiationParams{
+		version:         currentNegotiationVersion,
+		mtu:             uint16(proposedMTU),
+		maxFragmentSize: uint16(proposedMaxFragmentSize),
+		features:        supportedFeatures,
+	}
+	reqSeg := &segment{
+		metadata: &negotiationStruct{isResponse: false},
+		payload:  marshalNegotiationParams(req),
+	}
+	if err := writeNegotiationSegment(conn, reqSeg); err != nil {
+		return negotiationParams{}, fmt.Errorf("write negotiation request failed: %w", err)
+	}
+
+	respSeg, err := readNegotiationSegment(conn)
+	if err != nil {
+		return negotiationParams{}, fmt.Errorf("read negotiation response failed: %w", err)
+	}
+	resp, err := unmarshalNegotiationParams(respSeg.payload)
+	if err != nil {
+		return negotiationParams{}, fmt.Errorf("unmarshalNegotiationParams() failed: %w", err)
+	}
+	if resp.version > req.version {
+		return negotiationParams{}, fmt.Errorf("server accepted version %d higher than proposed %d", resp.version, req.version)
+	}
+	return resp, nil
+}
+
+// negotiateServer reads the client's proposal, downgrades it to whatever
+// this server supports, and replies with the accepted parameters.
+func negotiateServer(conn Underlay, localMTU, localMaxFragmentSize int) (negotiationParams, error) {
+	reqSeg, err := readNegotiationSegment(conn)
+	if err != nil {
+		return negotiationParams{}, fmt.Errorf("read negotiation request failed: %w", err)
+	}
+	req, err := unmarshalNegotiationParams(reqSeg.payload)
+	if err != nil {
+		return negotiationParams{}, fmt.Errorf("unmarshalNegotiationParams() failed: %w", err)
+	}
+
+	resp := negotiationParams{
+		version:         minUint8(req.version, currentNegotiationVersion),
+		mtu:             minUint16(req.mtu, uint16(localMTU)),
+		maxFragmentSize: minUint16(req.maxFragmentSize, uint16(localMaxFragmentSize)),
+		features:        req.features & supportedFeatures,
+	}
+	respSeg := &segment{
+		metadata: &negotiationStruct{isResponse: true},
+		payload:  marshalNegotiationParams(resp),
+	}
+	if err := writeNegotiationSegment(conn, respSeg); err != nil {
+		return negotiationParams{}, fmt.Errorf("write negotiation response failed: %w", err)
+	}
+	return resp, nil
+}
+
+func minUint8(a, b uint8) uint8 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func minUint16(a, b uint16) uint16 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// NewClientSession negotiates protocol version and parameters with the
+// server over conn, then returns a Session built with the negotiated MTU
+// rather than proposedMTU verbatim.
+func NewClientSession(conn Underlay, id uint32, proposedMTU int) (*Session, error) {
+	maxFragmentSize := MaxFragmentSize(proposedMTU, conn.IPVersion(), conn.TransportProtocol())
+	params, err := negotiateClient(conn, proposedMTU, maxFragmentSize)
+	if err != nil {
+		return nil, fmt.Errorf("negotiateClient() failed: %w", err)
+	}
+	s := NewSession(id, true, int(params.mtu))
+	s.conn = conn
+	s.features = params.features
+	return s, nil
+}
+
+// NewServerSession accepts the client's proposal over conn, downgrading it
+// to localMTU and this build's supported features if needed, then returns
+// a Session built with the negotiated MTU.
+func NewServerSession(conn Underlay, id uint32, localMTU int) (*Session, error) {
+	localMaxFragmentSize := MaxFragmentSize(localMTU, conn.IPVersion(), conn.TransportProtocol())
+	params, err := negotiateServer(conn, localMTU, localMaxFragmentSize)
+	if err != nil {
+		return nil, fmt.Errorf("negotiateServer() failed: %w", err)
+	}
+	s := NewSession(id, false, int(params.mtu))
+	s.conn = conn
+	s.features = params.features
+	return s, nil
+}
@@ -0,0 +1,85 @@
+// Copyright (C) 2023  mieru authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package protocolv2
+
+import "testing"
+
+func TestMarshalUnmarshalNegotiationParamsRoundTrip(t *testing.T) {
+	want := negotiationParams{
+		version:         currentNegotiationVersion,
+		mtu:             1400,
+		maxFragmentSize: 1200,
+		features:        featureUDPARQ | featureDelayedACK,
+	}
+
+	got, err := unmarshalNegotiationParams(marshalNegotiationParams(want))
+	if err != nil {
+		t.Fatalf("unmarshalNegotiationParams() failed: %v", err)
+	}
+	if got != want {
+		t.Fatalf("round trip = %+v, want %+v", got, want)
+	}
+}
+
+func TestUnmarshalNegotiationParamsTooShort(t *testing.T) {
+	if _, err := unmarshalNegotiationParams(make([]byte, negotiationWireSize-1)); err == nil {
+		t.Fatal("unmarshalNegotiationParams() with a short buffer should fail, got nil error")
+	}
+}
+
+func TestNegotiationStructProtocol(t *testing.T) {
+	req := &negotiationStruct{isResponse: false}
+	if got := req.Protocol(); got != negotiationRequest {
+		t.Fatalf("request Protocol() = %v, want negotiationRequest", got)
+	}
+
+	resp := &negotiationStruct{isResponse: true}
+	if got := resp.Protocol(); got != negotiationResponse {
+		t.Fatalf("response Protocol() = %v, want negotiationResponse", got)
+	}
+}
+
+func TestFeatureIntersectionDowngrade(t *testing.T) {
+	clientFeatures := featureUDPARQ | featureSACK | featureDelayedACK | featureCloseSession
+	serverSupported := featureUDPARQ | featureCloseSession // an older server build
+
+	got := clientFeatures & serverSupported
+	want := featureUDPARQ | featureCloseSession
+	if got != want {
+		t.Fatalf("negotiated features = %v, want %v", got, want)
+	}
+	if got&featureSACK != 0 {
+		t.Fatal("featureSACK should not survive intersection with a server that lacks it")
+	}
+}
+
+func TestMinUint8(t *testing.T) {
+	if minUint8(3, 5) != 3 {
+		t.Fatal("minUint8(3, 5) should be 3")
+	}
+	if minUint8(5, 3) != 3 {
+		t.Fatal("minUint8(5, 3) should be 3")
+	}
+}
+
+func TestMinUint16(t *testing.T) {
+	if minUint16(1400, 1200) != 1200 {
+		t.Fatal("minUint16(1400, 1200) should be 1200")
+	}
+	if minUint16(1200, 1400) != 1200 {
+		t.Fatal("minUint16(1200, 1400) should be 1200")
+	}
+}
@@ -0,0 +1,214 @@
+// Copyright (C) 2023  mieru authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package protocolv2
+
+import (
+	"container/heap"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/enfein/mieru/pkg/stderror"
+)
+
+// segmentTree is a bounded collection of segments keyed by sequence number.
+// Session uses four of them (sendQueue, sendBuf, recvBuf, recvQueue) as the
+// handoff points between Write/Read, the ARQ layer and the wire. Segments
+// always leave a tree in ascending sequence order via DeleteMin, while Peek
+// and Contains allow looking up an arbitrary sequence number without
+// removing it - this is what lets recvBuf reassemble out-of-order UDP
+// segments and sendBuf be cleaned up by seq once onAckReceived knows which
+// segments the peer has.
+//
+// Inserts block (via InsertBlocking / InsertBlockingContext) once the tree
+// holds capacity segments, so a fast writer or sender can't run a slow
+// reader or an unresponsive peer out of memory.
+type segmentTree struct {
+	mu       sync.Mutex
+	capacity int
+	byID     map[uint32]*segment
+	order    seqHeap
+}
+
+// newSegmentTree creates a segmentTree that holds at most capacity segments.
+func newSegmentTree(capacity int) *segmentTree {
+	return &segmentTree{
+		capacity: capacity,
+		byID:     make(map[uint32]*segment, capacity),
+	}
+}
+
+// Len returns the number of segments currently held.
+func (t *segmentTree) Len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.byID)
+}
+
+// Remaining returns how much spare capacity is left.
+func (t *segmentTree) Remaining() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.capacity - len(t.byID)
+}
+
+// Contains reports whether a segment with the given sequence number is held.
+func (t *segmentTree) Contains(seq uint32) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	_, ok := t.byID[seq]
+	return ok
+}
+
+// Peek returns the segment with the given sequence number without removing
+// it. It returns stderror.ErrEmpty if no such segment is held.
+func (t *segmentTree) Peek(seq uint32) (*segment, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	seg, ok := t.byID[seq]
+	if !ok {
+		return nil, stderror.ErrEmpty
+	}
+	return seg, nil
+}
+
+// DeleteMin removes and returns the segment with the smallest sequence
+// number. It returns stderror.ErrEmpty if the tree is empty.
+func (t *segmentTree) DeleteMin() (*segment, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.deleteMinLocked()
+}
+
+// DeleteMinBlockingContext behaves like DeleteMin, but instead of returning
+// stderror.ErrEmpty it polls until a segment is available or ctx is done.
+func (t *segmentTree) DeleteMinBlockingContext(ctx context.Context) (*segment, error) {
+	for {
+		t.mu.Lock()
+		seg, err := t.deleteMinLocked()
+		t.mu.Unlock()
+		if err == nil {
+			return seg, nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(segmentPollInterval):
+		}
+	}
+}
+
+func (t *segmentTree) deleteMinLocked() (*segment, error) {
+	if t.order.Len() == 0 {
+		return nil, stderror.ErrEmpty
+	}
+	seq := heap.Pop(&t.order).(uint32)
+	seg := t.byID[seq]
+	delete(t.byID, seq)
+	return seg, nil
+}
+
+// Delete removes the segment with the given sequence number, if any, and
+// reports whether a segment was actually removed. This is how onAckReceived
+// retires a segment from sendBuf once it has been cumulatively or
+// selectively acknowledged, independent of DeleteMin's ascending order.
+func (t *segmentTree) Delete(seq uint32) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.byID[seq]; !ok {
+		return false
+	}
+	delete(t.byID, seq)
+	t.order.removeSeq(seq)
+	return true
+}
+
+// InsertBlocking inserts seg, polling until there is room.
+func (t *segmentTree) InsertBlocking(seg *segment) error {
+	return t.InsertBlockingContext(context.Background(), seg)
+}
+
+// InsertBlockingContext inserts seg, polling until there is room or ctx is
+// done.
+func (t *segmentTree) InsertBlockingContext(ctx context.Context, seg *segment) error {
+	for {
+		t.mu.Lock()
+		if len(t.byID) < t.capacity {
+			t.insertLocked(seg)
+			t.mu.Unlock()
+			return nil
+		}
+		t.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(segmentPollInterval):
+		}
+	}
+}
+
+func (t *segmentTree) insertLocked(seg *segment) {
+	seq := seg.Seq()
+	if _, exists := t.byID[seq]; !exists {
+		heap.Push(&t.order, seq)
+	}
+	t.byID[seq] = seg
+}
+
+// seqHeap is a container/heap min-heap of sequence numbers, with an index
+// map so Delete can remove an arbitrary entry, not just the minimum.
+type seqHeap struct {
+	seqs    []uint32
+	indexOf map[uint32]int
+}
+
+func (h *seqHeap) Len() int { return len(h.seqs) }
+
+func (h *seqHeap) Less(i, j int) bool { return h.seqs[i] < h.seqs[j] }
+
+func (h *seqHeap) Swap(i, j int) {
+	h.seqs[i], h.seqs[j] = h.seqs[j], h.seqs[i]
+	if h.indexOf != nil {
+		h.indexOf[h.seqs[i]] = i
+		h.indexOf[h.seqs[j]] = j
+	}
+}
+
+func (h *seqHeap) Push(x any) {
+	seq := x.(uint32)
+	if h.indexOf == nil {
+		h.indexOf = make(map[uint32]int)
+	}
+	h.indexOf[seq] = len(h.seqs)
+	h.seqs = append(h.seqs, seq)
+}
+
+func (h *seqHeap) Pop() any {
+	n := len(h.seqs)
+	seq := h.seqs[n-1]
+	h.seqs = h.seqs[:n-1]
+	delete(h.indexOf, seq)
+	return seq
+}
+
+// removeSeq removes seq from the heap, wherever it currently sits.
+func (h *seqHeap) removeSeq(seq uint32) {
+	idx, ok := h.indexOf[seq]
+	if !ok {
+		return
+	}
+	heap.Remove(h, idx)
+}
@@ -21,7 +21,9 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/enfein/mieru/pkg/mathext"
@@ -57,6 +59,7 @@ type Session struct {
 	mtu      int           // L2 maxinum transmission unit
 	state    sessionState  // session state
 	done     chan struct{} // indicate the session is complete
+	features featureBit    // capabilities negotiated with the peer before this Session was usable
 
 	sendQueue *segmentTree  // segments waiting to send
 	sendBuf   *segmentTree  // segments sent but not acknowledged
@@ -68,6 +71,26 @@ type Session struct {
 	unackSeq  uint32 // unacknowledged sequence number
 	unreadBuf []byte // payload removed from the recvQueue that haven't been read by application
 
+	arq     *arqState  // UDP reliability/congestion state, unused over TCP
+	arqLock sync.Mutex // guards arq
+
+	readDeadline  deadlineTimer
+	writeDeadline deadlineTimer
+
+	metrics        *sessionMetrics
+	sendQueueDepth int        // soft cap on sendQueue size, enforced by dropPolicy
+	dropPolicy     DropPolicy // what Write does once sendQueueDepth is reached
+
+	stateLock           sync.Mutex    // guards state
+	closeOnce           sync.Once     // Close runs its shutdown sequence exactly once
+	readClosed          atomic.Bool   // CloseRead (or Close) was called locally
+	writeClosed         atomic.Bool   // CloseWrite (or Close) was called locally
+	localReadClosedChan chan struct{} // closed when readClosed becomes true
+	peerFinChan         chan struct{} // closed once a closeSessionRequest has been processed (over UDP, once data up to its finalSeq has arrived)
+	peerFinOnce         sync.Once
+	closeRespChan       chan struct{} // closed once closeSessionResponse is received
+	closeRespOnce       sync.Once
+
 	wg    sync.WaitGroup
 	rLock sync.Mutex
 	wLock sync.Mutex
@@ -79,20 +102,69 @@ var _ net.Conn = &Session{}
 // NewSession creates a new session.
 func NewSession(id uint32, isClient bool, mtu int) *Session {
 	return &Session{
-		conn:      nil,
-		id:        id,
-		isClient:  isClient,
-		mtu:       mtu,
-		state:     sessionInit,
-		done:      make(chan struct{}),
-		sendQueue: newSegmentTree(segmentTreeCapacity),
-		sendBuf:   newSegmentTree(segmentTreeCapacity),
-		recvBuf:   newSegmentTree(segmentTreeCapacity),
-		recvQueue: newSegmentTree(segmentTreeCapacity),
-		recvChan:  make(chan *segment, segmentChanCapacity),
+		conn:     nil,
+		id:       id,
+		isClient: isClient,
+		mtu:      mtu,
+		state:    sessionInit,
+		done:     make(chan struct{}),
+		// A Session built directly (bypassing NewClientSession/NewServerSession)
+		// never ran the negotiation in negotiation.go, so default to every
+		// feature this build supports rather than leaving the bitmap at its
+		// zero value, which would silently disable SACK, delayed ACK, the UDP
+		// retransmission loop and close-session handshaking.
+		features:            supportedFeatures,
+		sendQueue:           newSegmentTree(segmentTreeCapacity),
+		sendBuf:             newSegmentTree(segmentTreeCapacity),
+		recvBuf:             newSegmentTree(segmentTreeCapacity),
+		recvQueue:           newSegmentTree(segmentTreeCapacity),
+		recvChan:            make(chan *segment, segmentChanCapacity),
+		arq:                 newARQState(),
+		readDeadline:        makeDeadlineTimer(),
+		writeDeadline:       makeDeadlineTimer(),
+		metrics:             newSessionMetrics(id),
+		sendQueueDepth:      defaultSendQueueDepth,
+		dropPolicy:          DropPolicyBlockWriter,
+		localReadClosedChan: make(chan struct{}),
+		peerFinChan:         make(chan struct{}),
+		closeRespChan:       make(chan struct{}),
 	}
 }
 
+// SetSendQueueDepth overrides the default send-queue depth. It should be
+// called before the session starts carrying traffic.
+func (s *Session) SetSendQueueDepth(depth int) {
+	s.sendQueueDepth = depth
+}
+
+// SetDropPolicy overrides what Write does once the send queue reaches
+// SetSendQueueDepth. It should be called before the session starts
+// carrying traffic.
+func (s *Session) SetDropPolicy(p DropPolicy) {
+	s.dropPolicy = p
+}
+
+// enqueueSend applies the configured DropPolicy before handing seg to
+// sendQueue: DropPolicyBlockWriter waits for room exactly like a plain
+// InsertBlockingContext would if sendQueueDepth matched the tree's own
+// capacity; DropPolicyDropOldest instead evicts the oldest unsent segment
+// so the writer never stalls behind a slow or vanished peer.
+func (s *Session) enqueueSend(ctx context.Context, seg *segment) error {
+	for s.dropPolicy == DropPolicyBlockWriter && s.sendQueue.Len() >= s.sendQueueDepth {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(segmentPollInterval):
+		}
+	}
+	if s.dropPolicy == DropPolicyDropOldest && s.sendQueue.Len() >= s.sendQueueDepth {
+		if _, err := s.sendQueue.DeleteMin(); err == nil {
+			s.metrics.addDropped(dropReasonQueueFull)
+		}
+	}
+	return s.sendQueue.InsertBlockingContext(ctx, seg)
+}
+
 // Read lets a user to read data from receive queue.
 // The data boundary is preserved, i.e. no fragment read.
 func (s *Session) Read(b []byte) (n int, err error) {
@@ -112,7 +184,28 @@ func (s *Session) Read(b []byte) (n int, err error) {
 
 	// Read all the fragments of the original message.
 	for {
-		seg := s.recvQueue.DeleteMinBlocking()
+		// A non-blocking attempt first, so data that arrived before a
+		// concurrent CloseRead/Close/peer FIN is still delivered instead
+		// of being raced against the resulting EOF.
+		seg, err := s.recvQueue.DeleteMin()
+		if err != nil {
+			if !errors.Is(err, stderror.ErrEmpty) {
+				return 0, fmt.Errorf("recvQueue.DeleteMin() failed: %w", err)
+			}
+			if s.isReadClosed() {
+				return 0, io.EOF
+			}
+			ctx, cause := s.readContext()
+			seg, err = s.recvQueue.DeleteMinBlockingContext(ctx)
+			if err != nil {
+				if c := cause(); c != nil {
+					return 0, c
+				}
+				return 0, fmt.Errorf("recvQueue.DeleteMinBlockingContext() failed: %w", err)
+			}
+			cause()
+		}
+
 		if len(s.unreadBuf) == 0 {
 			s.unreadBuf = seg.payload
 		} else {
@@ -138,6 +231,9 @@ func (s *Session) Read(b []byte) (n int, err error) {
 
 // Write stores the data to send queue.
 func (s *Session) Write(b []byte) (n int, err error) {
+	if s.writeClosed.Load() {
+		return 0, io.ErrClosedPipe
+	}
 	if len(b) > MaxPDU {
 		return 0, io.ErrShortWrite
 	}
@@ -165,23 +261,28 @@ func (s *Session) Write(b []byte) (n int, err error) {
 			},
 			payload: part,
 		}
+
+		ctx, cause := s.withDeadline(&s.writeDeadline)
+		err := s.enqueueSend(ctx, seg)
+		if err != nil {
+			if c := cause(); c != nil {
+				if c == os.ErrDeadlineExceeded {
+					s.metrics.addDropped(dropReasonWriteTimeout)
+				}
+				return len(b) - len(ptr), c
+			}
+			return len(b) - len(ptr), fmt.Errorf("enqueueSend() failed: %w", err)
+		}
+		cause()
+
 		s.nextSeq++
-		s.sendQueue.InsertBlocking(seg)
 		ptr = ptr[partLen:]
 	}
 
 	return len(b), nil
 }
 
-// Close terminates the session at our end.
-func (s *Session) Close() error {
-	s.rLock.Lock()
-	s.wLock.Lock()
-	defer s.rLock.Unlock()
-	defer s.wLock.Unlock()
-	close(s.done)
-	return nil
-}
+// Close, CloseRead and CloseWrite are implemented in close.go.
 
 func (s *Session) LocalAddr() net.Addr {
 	return s.conn.LocalAddr()
@@ -192,15 +293,19 @@ func (s *Session) RemoteAddr() net.Addr {
 }
 
 func (s *Session) SetDeadline(t time.Time) error {
-	return stderror.ErrUnsupported
+	s.readDeadline.set(t)
+	s.writeDeadline.set(t)
+	return nil
 }
 
 func (s *Session) SetReadDeadline(t time.Time) error {
-	return stderror.ErrUnsupported
+	s.readDeadline.set(t)
+	return nil
 }
 
 func (s *Session) SetWriteDeadline(t time.Time) error {
-	return stderror.ErrUnsupported
+	s.writeDeadline.set(t)
+	return nil
 }
 
 func (s *Session) runInputLoop(ctx context.Context) error {
@@ -219,6 +324,19 @@ func (s *Session) runInputLoop(ctx context.Context) error {
 }
 
 func (s *Session) runOutputLoop(ctx context.Context) error {
+	if s.conn.TransportProtocol() == netutil.UDPTransport && s.features&featureUDPARQ != 0 {
+		// The retransmission loop is part of the UDP output path: it is
+		// what actually frees a slot in arq.inFlight (and therefore
+		// availableWindow()) when an ACK never arrives. Starting it
+		// alongside runOutputLoop keeps every UDP session's background
+		// goroutines started from a single place. It is skipped entirely
+		// when the peer negotiated away featureUDPARQ.
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.runRetransmissionLoop(ctx)
+		}()
+	}
 	for {
 		select {
 		case <-ctx.Done():
@@ -242,6 +360,33 @@ func (s *Session) runOutputLoop(ctx context.Context) error {
 						return fmt.Errorf("output() failed: %v", err)
 					}
 				}
+			case netutil.UDPTransport:
+				s.arqLock.Lock()
+				n := s.arq.availableWindow()
+				s.arqLock.Unlock()
+				if n == 0 {
+					time.Sleep(segmentPollInterval)
+					break
+				}
+				for ; n > 0; n-- {
+					seg, err := s.sendQueue.DeleteMin()
+					if err != nil {
+						if errors.Is(err, stderror.ErrEmpty) {
+							break
+						}
+						return fmt.Errorf("sendQueue.DeleteMin() failed: %v", err)
+					}
+					// Move the segment from sendQueue to sendBuf and start
+					// its RTO timer before handing it to the wire, so an
+					// ACK that races the write is never missed.
+					s.sendBuf.InsertBlocking(seg)
+					s.arqLock.Lock()
+					s.onSegmentSent(seg)
+					s.arqLock.Unlock()
+					if err := s.output(seg); err != nil {
+						return fmt.Errorf("output() failed: %v", err)
+					}
+				}
 			default:
 				return fmt.Errorf("unsupported transport protocol %v", s.conn.TransportProtocol())
 			}
@@ -252,6 +397,7 @@ func (s *Session) runOutputLoop(ctx context.Context) error {
 // input reads incoming packets from network and assemble
 // them in the receive buffer and receive queue.
 func (s *Session) input(seg *segment) error {
+	s.metrics.addRecv(len(seg.payload))
 	protocol := seg.Protocol()
 	if s.isClient {
 		if protocol != dataServerToClient && protocol != ackServerToClient && protocol != closeSessionRequest && protocol != closeSessionResponse {
@@ -268,6 +414,12 @@ func (s *Session) input(seg *segment) error {
 	if protocol == ackServerToClient || protocol == ackClientToServer {
 		return s.inputAck(seg)
 	}
+	if protocol == closeSessionRequest {
+		return s.inputCloseSessionRequest(seg)
+	}
+	if protocol == closeSessionResponse {
+		return s.inputCloseSessionResponse(seg)
+	}
 	return nil
 }
 
@@ -277,16 +429,74 @@ func (s *Session) inputData(seg *segment) error {
 		// Deliver the segment directly to recvQueue.
 		s.recvQueue.InsertBlocking(seg)
 		return nil
+	case netutil.UDPTransport:
+		return s.inputDataUDP(seg)
 	default:
 		return fmt.Errorf("unsupported transport protocol %v", s.conn.TransportProtocol())
 	}
 }
 
+// inputDataUDP places an out-of-order capable segment into recvBuf, then
+// promotes the longest contiguous run starting at the next expected
+// sequence number into recvQueue where Read can see it. A delayed ACK is
+// always scheduled so the sender learns about both holes and progress.
+func (s *Session) inputDataUDP(seg *segment) error {
+	if err := s.recvBuf.InsertBlocking(seg); err != nil {
+		return fmt.Errorf("recvBuf.InsertBlocking() failed: %w", err)
+	}
+
+	s.promoteContiguousRecv()
+
+	s.scheduleDelayedAck()
+	return nil
+}
+
+// promoteContiguousRecv moves the longest run of recvBuf starting at
+// arq.nextRecvSeq into recvQueue, then signals the peer's FIN if one was
+// seen and nextRecvSeq has now caught up to its finalSeq. Both inputDataUDP
+// and inputCloseSessionRequest call this: a closeSessionRequest can arrive
+// before the data segments it followed, so completion can only be declared
+// once reassembly genuinely reaches finalSeq, not merely once the request
+// itself is seen.
+func (s *Session) promoteContiguousRecv() {
+	s.arqLock.Lock()
+	for {
+		next, err := s.recvBuf.Peek(s.arq.nextRecvSeq)
+		if err != nil {
+			break
+		}
+		if _, err := s.recvBuf.DeleteMin(); err != nil {
+			break
+		}
+		s.arq.nextRecvSeq++
+		s.arqLock.Unlock()
+		s.recvQueue.InsertBlocking(next)
+		s.arqLock.Lock()
+	}
+	complete := s.arq.peerFinalSeqKnown && s.arq.nextRecvSeq >= s.arq.peerFinalSeq
+	s.arqLock.Unlock()
+
+	if complete {
+		s.peerFinOnce.Do(func() { close(s.peerFinChan) })
+	}
+}
+
 func (s *Session) inputAck(seg *segment) error {
 	switch s.conn.TransportProtocol() {
 	case netutil.TCPTransport:
 		// Do nothing when receive ACK from TCP protocol.
 		return nil
+	case netutil.UDPTransport:
+		var sack uint32
+		if s.features&featureSACK != 0 {
+			var err error
+			sack, err = decodeSACKPayload(seg.payload)
+			if err != nil {
+				return fmt.Errorf("decodeSACKPayload() failed: %w", err)
+			}
+		}
+		s.onAckReceived(seg.UnAckSeq(), sack, seg.WindowSize())
+		return nil
 	default:
 		return fmt.Errorf("unsupported transport protocol %v", s.conn.TransportProtocol())
 	}
@@ -298,8 +508,13 @@ func (s *Session) output(seg *segment) error {
 		if err := s.conn.(*TCPUnderlay).writeOneSegment(seg); err != nil {
 			return fmt.Errorf("TCPUnderlay.writeOneSegment() failed: %v", err)
 		}
+	case netutil.UDPTransport:
+		if err := s.conn.(*UDPUnderlay).writeOneSegment(seg); err != nil {
+			return fmt.Errorf("UDPUnderlay.writeOneSegment() failed: %v", err)
+		}
 	default:
 		return fmt.Errorf("unsupported transport protocol %v", s.conn.TransportProtocol())
 	}
+	s.metrics.addSent(len(seg.payload))
 	return nil
-}
\ No newline at end of file
+}
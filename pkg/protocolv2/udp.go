@@ -0,0 +1,103 @@
+// Copyright (C) 2023  mieru authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package protocolv2
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/enfein/mieru/pkg/netutil"
+)
+
+// UDPUnderlay is a Underlay backed by a single UDP socket.
+//
+// Unlike TCPUnderlay, UDP provides no ordering or delivery guarantees,
+// so Session relies on the ARQ layer in arq.go (sendBuf / recvBuf bookkeeping,
+// retransmission timers and a sliding congestion window) to turn it into a
+// reliable, ordered byte stream.
+type UDPUnderlay struct {
+	conn      *net.UDPConn
+	laddr     net.Addr
+	raddr     net.Addr
+	ipVersion netutil.IPVersion
+}
+
+var _ Underlay = &UDPUnderlay{}
+
+// NewUDPUnderlay wraps an already connected *net.UDPConn.
+func NewUDPUnderlay(conn *net.UDPConn, ipVersion netutil.IPVersion) *UDPUnderlay {
+	return &UDPUnderlay{
+		conn:      conn,
+		laddr:     conn.LocalAddr(),
+		raddr:     conn.RemoteAddr(),
+		ipVersion: ipVersion,
+	}
+}
+
+func (u *UDPUnderlay) IPVersion() netutil.IPVersion {
+	return u.ipVersion
+}
+
+func (u *UDPUnderlay) TransportProtocol() netutil.TransportProtocol {
+	return netutil.UDPTransport
+}
+
+func (u *UDPUnderlay) LocalAddr() net.Addr {
+	return u.laddr
+}
+
+func (u *UDPUnderlay) RemoteAddr() net.Addr {
+	return u.raddr
+}
+
+// writeOneSegment serializes seg and sends it as a single UDP datagram.
+// There is no fragmentation below this layer, so callers must keep segments
+// within MaxFragmentSize for this transport.
+func (u *UDPUnderlay) writeOneSegment(seg *segment) error {
+	b, err := seg.Marshal()
+	if err != nil {
+		return fmt.Errorf("segment.Marshal() failed: %w", err)
+	}
+	if _, err := u.conn.Write(b); err != nil {
+		return fmt.Errorf("UDPConn.Write() failed: %w", err)
+	}
+	return nil
+}
+
+// readOneSegment reads a single UDP datagram and parses it back into a segment.
+func (u *UDPUnderlay) readOneSegment(buf []byte) (*segment, error) {
+	n, err := u.conn.Read(buf)
+	if err != nil {
+		return nil, fmt.Errorf("UDPConn.Read() failed: %w", err)
+	}
+	seg, err := ParseSegment(buf[:n])
+	if err != nil {
+		return nil, fmt.Errorf("ParseSegment() failed: %w", err)
+	}
+	return seg, nil
+}
+
+// Read and Write make UDPUnderlay an io.ReadWriter over the raw socket,
+// bypassing segment framing. The pre-session negotiation in negotiation.go
+// does not use them; it exchanges segments via writeOneSegment and
+// readOneSegment.
+func (u *UDPUnderlay) Read(b []byte) (int, error) {
+	return u.conn.Read(b)
+}
+
+func (u *UDPUnderlay) Write(b []byte) (int, error) {
+	return u.conn.Write(b)
+}